@@ -0,0 +1,68 @@
+// Package csvexp implements flowtuple.Exporter, writing records as
+// RFC 4180 CSV in the same field order as flowtuple.FlowRec.String.
+package csvexp
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+
+	"github.com/kshedden/flowtuple"
+)
+
+// Exporter writes flowtuple records as CSV with a header row.
+type Exporter struct {
+	w *csv.Writer
+
+	// WithContext adds inum and classid columns when true. Set it
+	// before calling WriteHeader.
+	WithContext bool
+}
+
+// New returns an Exporter that writes CSV to w.
+func New(w io.Writer) *Exporter {
+	cw := csv.NewWriter(w)
+	cw.UseCRLF = true
+	return &Exporter{w: cw}
+}
+
+var baseHeader = []string{
+	"src_ip", "dst_ip", "src_port", "dst_port",
+	"protocol", "flags", "ttl", "ip_len", "count",
+}
+
+// WriteHeader writes the CSV header row.
+func (e *Exporter) WriteHeader() error {
+	header := baseHeader
+	if e.WithContext {
+		header = append([]string{"inum", "classid"}, baseHeader...)
+	}
+	return e.w.Write(header)
+}
+
+// WriteRecord writes one record as a CSV row.
+func (e *Exporter) WriteRecord(ctx flowtuple.RecordContext, rec *flowtuple.FlowRec) error {
+
+	fields := []string{
+		rec.ResolvedSrcAddr().String(),
+		rec.ResolvedDstAddr().String(),
+		strconv.Itoa(int(rec.SrcPort)),
+		strconv.Itoa(int(rec.DstPort)),
+		strconv.Itoa(int(rec.Protocol)),
+		strconv.Itoa(int(rec.Flags)),
+		strconv.Itoa(int(rec.Ttl)),
+		strconv.Itoa(int(rec.IPLen)),
+		strconv.FormatUint(uint64(rec.Count), 10),
+	}
+	if e.WithContext {
+		fields = append([]string{strconv.Itoa(ctx.Inum), strconv.Itoa(ctx.ClassId)}, fields...)
+	}
+
+	return e.w.Write(fields)
+}
+
+// Close flushes buffered output.
+func (e *Exporter) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
@@ -0,0 +1,83 @@
+package csvexp
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/netip"
+	"testing"
+
+	"github.com/kshedden/flowtuple"
+)
+
+func TestExporter(t *testing.T) {
+
+	var buf bytes.Buffer
+	e := New(&buf)
+	e.WithContext = true
+
+	if err := e.WriteHeader(); err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+
+	rec := &flowtuple.FlowRec{SrcAddr: netip.MustParseAddr("1.2.3.4"), DstAddr: netip.MustParseAddr("5.6.7.0"), SrcPort: 80, DstPort: 443, Protocol: 6, Count: 7}
+	ctx := flowtuple.RecordContext{Inum: 1, ClassId: 2, IntervalStart: 1000, Rec: rec}
+
+	if err := e.WriteRecord(ctx, rec); err != nil {
+		t.Fatalf("WriteRecord failed: %v", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	r := csv.NewReader(bytes.NewReader(buf.Bytes()))
+	rows, err := r.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+	want := []string{"1", "2", "1.2.3.4", "5.6.7.0", "80", "443", "6", "0", "0", "0", "7"}
+	if len(rows[1]) != len(want) {
+		t.Fatalf("got %v, want %v", rows[1], want)
+	}
+	for i := range want {
+		if rows[1][i] != want[i] {
+			t.Fatalf("field %d: got %q, want %q", i, rows[1][i], want[i])
+		}
+	}
+}
+
+// TestExporterLegacyFields checks that a FlowRec built with only the
+// deprecated SrcIP/DstIP fields still exports the right addresses,
+// rather than silently writing "invalid IP".
+func TestExporterLegacyFields(t *testing.T) {
+
+	var buf bytes.Buffer
+	e := New(&buf)
+
+	rec := &flowtuple.FlowRec{SrcIP: 0x01020304, DstIP: 0x05060700, SrcPort: 80, DstPort: 443, Protocol: 6}
+	ctx := flowtuple.RecordContext{Rec: rec}
+
+	if err := e.WriteHeader(); err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+	if err := e.WriteRecord(ctx, rec); err != nil {
+		t.Fatalf("WriteRecord failed: %v", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	r := csv.NewReader(bytes.NewReader(buf.Bytes()))
+	rows, err := r.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+	if rows[1][0] != "1.2.3.4" || rows[1][1] != "5.6.7.0" {
+		t.Fatalf("got %v, want src 1.2.3.4 dst 5.6.7.0", rows[1])
+	}
+}
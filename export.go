@@ -0,0 +1,45 @@
+// Exporter lets a flowtuple file be converted to other formats without
+// each format needing its own copy of the interval/class/record read
+// loop; see the jsonexp, csvexp, and pcapexp subpackages for built-in
+// implementations.
+
+package flowtuple
+
+import "io"
+
+// Exporter writes flowtuple records to some external sink. Convert
+// drives a FlowtupleReader into any Exporter.
+type Exporter interface {
+
+	// WriteHeader writes any preamble the format requires (e.g. a CSV
+	// header row). It is called once, before the first WriteRecord.
+	WriteHeader() error
+
+	// WriteRecord writes one record, with its interval/class context.
+	WriteRecord(ctx RecordContext, rec *FlowRec) error
+
+	// Close finishes writing the export. It does not close the
+	// underlying writer, which the caller owns.
+	Close() error
+}
+
+// Convert reads every record from src and writes it to e, calling
+// e.WriteHeader before the first record and e.Close after the last.
+func Convert(src io.Reader, e Exporter) error {
+
+	if err := e.WriteHeader(); err != nil {
+		return err
+	}
+
+	ftr := NewFlowtupleReader(src)
+	for ctx, err := range ftr.Records() {
+		if err != nil {
+			return err
+		}
+		if err := e.WriteRecord(ctx, ctx.Rec); err != nil {
+			return err
+		}
+	}
+
+	return e.Close()
+}
@@ -4,15 +4,37 @@
 // The flowtuple file format is documented here:
 //
 // http://www.caida.org/tools/measurement/corsaro/docs/formats.html
+//
+// Most callers should read a file with (*FlowtupleReader).Records,
+// which handles the interval/class/record nesting internally. The
+// lower-level ReadIntervalHead/ReadClassHead/ReadRec/ReadClassTail/
+// ReadIntervalTail methods remain available for callers that need
+// finer control over the read loop.
 
 package flowtuple
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
+	"net/netip"
+)
+
+// defaultBufSize is the size of the bufio.Reader/Writer wrapped around
+// the caller's io.Reader/io.Writer.  Flowtuple files are read and
+// written sequentially in small fixed-size chunks, so a generous
+// buffer keeps syscalls rare.
+const defaultBufSize = 256 * 1024
+
+// Magic numbers delimiting a flowtuple stream. The file ends with four
+// zero bytes in the place where the next magicGlobal would be.
+const (
+	magicGlobal   uint32 = 0x45444752
+	magicInterval uint32 = 0x494e5452
+	magicClass    uint32 = 0x53495854
 )
 
 type FlowtupleReader struct {
@@ -20,6 +42,9 @@ type FlowtupleReader struct {
 	// Read flowtuples from this file
 	r io.Reader
 
+	// Buffered view of r used for all parsing
+	br *bufio.Reader
+
 	// Current interval
 	inum int
 
@@ -32,8 +57,17 @@ type FlowtupleReader struct {
 	// Number of current record
 	recnum int
 
+	// Start time of the current interval
+	istart uint32
+
+	// End time of the current interval, set once its tail is read
+	iend uint32
+
 	// Write log to this file
 	logger *log.Logger
+
+	// Index attached with UseIndex, enabling SeekInterval/SeekClass
+	idx *Index
 }
 
 func (ftr *FlowtupleReader) ClassId() int {
@@ -44,10 +78,28 @@ func (ftr *FlowtupleReader) Inum() int {
 	return ftr.inum
 }
 
+// IntervalStart returns the start time of the current interval.
+func (ftr *FlowtupleReader) IntervalStart() uint32 {
+	return ftr.istart
+}
+
+// IntervalEnd returns the end time of the current interval. It reads
+// as 0 until ReadIntervalTail has been called, since the flowtuple
+// format only records an interval's end time after all of its classes.
+func (ftr *FlowtupleReader) IntervalEnd() uint32 {
+	return ftr.iend
+}
+
 func NewFlowtupleReader(r io.Reader) *FlowtupleReader {
 
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReaderSize(r, defaultBufSize)
+	}
+
 	return &FlowtupleReader{
-		r: r,
+		r:  r,
+		br: br,
 	}
 }
 
@@ -56,13 +108,34 @@ func (ftr *FlowtupleReader) SetLogger(logger *log.Logger) *FlowtupleReader {
 	return ftr
 }
 
+// recSize is the on-the-wire size in bytes of one flowtuple record:
+// 4 (SrcIP) + 3 (truncated DstIP) + 2 (SrcPort) + 2 (DstPort) + 1
+// (Protocol) + 1 (Flags) + 1 (Ttl) + 2 (IPLen) + 4 (Count).
+const recSize = 20
+
 // FlowRec contains one record in a flowtuple file.
 type FlowRec struct {
 
 	// Source IP address
+	SrcAddr netip.Addr
+
+	// Destination IP address. Corsaro only records the top DstIPMask
+	// bits of the real destination address, so DstAddr reads as that
+	// prefix with its remaining bits zeroed.
+	DstAddr netip.Addr
+
+	// DstIPMask is the number of leading bits of DstAddr that were
+	// present on the wire.
+	DstIPMask uint8
+
+	// SrcIP is a deprecated alias for SrcAddr as a big-endian uint32.
+	//
+	// Deprecated: use SrcAddr.
 	SrcIP uint32
 
-	// Destination IP address
+	// DstIP is a deprecated alias for DstAddr as a big-endian uint32.
+	//
+	// Deprecated: use DstAddr.
 	DstIP uint32
 
 	// Source port number
@@ -90,55 +163,82 @@ type FlowRec struct {
 }
 
 // ReadFrom reads a record from a flowtuple file into the flowrec struct.
+// It reads the fixed-size record slab in a single call and decodes the
+// fields directly with encoding/binary's byte-order helpers, avoiding
+// the reflection and per-field io.Reader traffic of binary.Read.
 func (fr *FlowRec) ReadFrom(gid io.Reader) error {
 
-	if len(fr.buf) == 0 {
-		fr.buf = make([]byte, 4)
+	if cap(fr.buf) < recSize {
+		fr.buf = make([]byte, recSize)
 	}
+	buf := fr.buf[:recSize]
 
-	binary.Read(gid, binary.BigEndian, &fr.SrcIP)
-
-	for k := 0; k < 4; k++ {
-		fr.buf[k] = 0
-	}
-	n, err := gid.Read(fr.buf[1:4])
-	if err != nil {
+	if _, err := io.ReadFull(gid, buf); err != nil {
 		return err
 	}
-	if n != 3 {
-		return fmt.Errorf("Incomplete read")
-	}
-	binary.Read(bytes.NewReader(fr.buf), binary.BigEndian, &fr.DstIP)
 
-	binary.Read(gid, binary.BigEndian, &fr.SrcPort)
-	binary.Read(gid, binary.BigEndian, &fr.DstPort)
-	binary.Read(gid, binary.BigEndian, &fr.Protocol)
-	binary.Read(gid, binary.BigEndian, &fr.Flags)
-	binary.Read(gid, binary.BigEndian, &fr.Ttl)
-	binary.Read(gid, binary.BigEndian, &fr.IPLen)
-	binary.Read(gid, binary.BigEndian, &fr.Count)
+	fr.decode(buf)
 
 	return nil
 }
 
-// fmtIP formats an IP address as a string.
-func fmtIP(x uint32) string {
+// decode unpacks a recSize-byte record slab into the receiver's fields.
+func (fr *FlowRec) decode(buf []byte) {
+
+	fr.SrcAddr = netip.AddrFrom4([4]byte(buf[0:4]))
+	fr.SrcIP = binary.BigEndian.Uint32(buf[0:4])
+
+	// Only the top 3 octets of the destination address are present on
+	// the wire; the bits past the leading DstIPMask bits read as zero.
+	var dstb [4]byte
+	copy(dstb[0:3], buf[4:7])
+	fr.DstAddr = netip.AddrFrom4(dstb)
+	fr.DstIPMask = 24
+	fr.DstIP = binary.BigEndian.Uint32(dstb[:])
+
+	fr.SrcPort = binary.BigEndian.Uint16(buf[7:9])
+	fr.DstPort = binary.BigEndian.Uint16(buf[9:11])
+	fr.Protocol = buf[11]
+	fr.Flags = buf[12]
+	fr.Ttl = buf[13]
+	fr.IPLen = binary.BigEndian.Uint16(buf[14:16])
+	fr.Count = binary.BigEndian.Uint32(buf[16:20])
+}
 
-	var y [4]uint8
-	for j := 0; j < 4; j++ {
-		y[j] = uint8(x % 256)
-		x /= 256
-	}
+// ResolvedSrcAddr returns SrcAddr, falling back to the deprecated SrcIP
+// for a FlowRec built by a caller that has not migrated yet. Callers
+// outside this package (e.g. Exporter implementations) should use this
+// instead of reading SrcAddr directly, so that records built with only
+// the deprecated field still resolve to the right address.
+func (fr FlowRec) ResolvedSrcAddr() netip.Addr {
+	if fr.SrcAddr.IsValid() {
+		return fr.SrcAddr
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], fr.SrcIP)
+	return netip.AddrFrom4(b)
+}
 
-	var b bytes.Buffer
-	for j := 0; j < 4; j++ {
-		b.Write([]byte(fmt.Sprintf("%d", y[3-j])))
-		if j < 3 {
-			b.Write([]byte("."))
-		}
+// ResolvedDstAddr returns DstAddr, falling back to the deprecated DstIP
+// for a FlowRec built by a caller that has not migrated yet. See
+// ResolvedSrcAddr.
+func (fr FlowRec) ResolvedDstAddr() netip.Addr {
+	if fr.DstAddr.IsValid() {
+		return fr.DstAddr
 	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], fr.DstIP)
+	return netip.AddrFrom4(b)
+}
 
-	return b.String()
+// addrTo4 returns the 4-byte representation of addr. netip.Addr.As4
+// panics on anything that isn't IPv4 or IPv4-in-IPv6, so callers that
+// accept arbitrary addresses (e.g. WriteRec) must check first.
+func addrTo4(addr netip.Addr) ([4]byte, error) {
+	if !addr.Is4() && !addr.Is4In6() {
+		return [4]byte{}, fmt.Errorf("address %s is not IPv4", addr)
+	}
+	return addr.As4(), nil
 }
 
 // String provides a string representation of a flowtuple record.
@@ -146,8 +246,8 @@ func (fr FlowRec) String() string {
 
 	var b bytes.Buffer
 
-	b.Write([]byte(fmt.Sprintf("%s|", fmtIP(fr.SrcIP))))
-	b.Write([]byte(fmt.Sprintf("%s|", fmtIP(fr.DstIP))))
+	b.Write([]byte(fmt.Sprintf("%s|", fr.ResolvedSrcAddr())))
+	b.Write([]byte(fmt.Sprintf("%s|", fr.ResolvedDstAddr())))
 	b.Write([]byte(fmt.Sprintf("%d|", fr.SrcPort)))
 	b.Write([]byte(fmt.Sprintf("%d|", fr.DstPort)))
 	b.Write([]byte(fmt.Sprintf("%d|", fr.Protocol)))
@@ -163,28 +263,28 @@ func (ftr *FlowtupleReader) ReadIntervalHead() error {
 
 	// Should be magic number 0x45444752
 	var magic uint32
-	err := binary.Read(ftr.r, binary.BigEndian, &magic)
+	err := binary.Read(ftr.br, binary.BigEndian, &magic)
 	if err != nil {
 		return err
 	}
 	if magic == 0 {
 		// Not documented, but magic=0 seems to end the file
 		return io.EOF
-	} else if magic != 0x45444752 {
+	} else if magic != magicGlobal {
 		return fmt.Errorf("Incorrect magic number %x\n", magic)
 	}
 
 	// Should be interval magic number 0x494E5452
-	err = binary.Read(ftr.r, binary.BigEndian, &magic)
+	err = binary.Read(ftr.br, binary.BigEndian, &magic)
 	if err != nil {
 		return err
 	}
-	if magic != 0x494e5452 {
+	if magic != magicInterval {
 		return fmt.Errorf("Incorrect magic number %x\n", magic)
 	}
 
 	var inum uint16
-	err = binary.Read(ftr.r, binary.BigEndian, &inum)
+	err = binary.Read(ftr.br, binary.BigEndian, &inum)
 	if err != nil {
 		panic(err)
 	}
@@ -194,13 +294,15 @@ func (ftr *FlowtupleReader) ReadIntervalHead() error {
 	ftr.inum = int(inum)
 
 	var istart uint32
-	err = binary.Read(ftr.r, binary.BigEndian, &istart)
+	err = binary.Read(ftr.br, binary.BigEndian, &istart)
 	if err != nil {
 		return err
 	}
 	if ftr.logger != nil {
 		ftr.logger.Printf("Interval start time: %v\n", istart)
 	}
+	ftr.istart = istart
+	ftr.iend = 0
 
 	return nil
 }
@@ -209,19 +311,19 @@ func (ftr *FlowtupleReader) ReadClassHead() error {
 
 	// Should be flowtuple magic 0x53495854
 	var magic uint32
-	err := binary.Read(ftr.r, binary.BigEndian, &magic)
+	err := binary.Read(ftr.br, binary.BigEndian, &magic)
 	if err != nil {
 		panic(err)
 	}
-	if magic == 0x45444752 {
+	if magic == magicGlobal {
 		// Done with this interval
 		return io.EOF
-	} else if magic != 0x53495854 {
+	} else if magic != magicClass {
 		return fmt.Errorf("Incorrect magic: %x\n", magic)
 	}
 
 	var classid uint16
-	err = binary.Read(ftr.r, binary.BigEndian, &classid)
+	err = binary.Read(ftr.br, binary.BigEndian, &classid)
 	if err != nil {
 		return err
 	}
@@ -231,7 +333,7 @@ func (ftr *FlowtupleReader) ReadClassHead() error {
 	ftr.classid = int(classid)
 
 	var keycnt uint32
-	err = binary.Read(ftr.r, binary.BigEndian, &keycnt)
+	err = binary.Read(ftr.br, binary.BigEndian, &keycnt)
 	if err != nil {
 		return err
 	}
@@ -250,7 +352,7 @@ func (ftr *FlowtupleReader) ReadRec(frec *FlowRec) error {
 	if ftr.recnum >= ftr.keycnt {
 		return io.EOF
 	}
-	err := frec.ReadFrom(ftr.r)
+	err := frec.ReadFrom(ftr.br)
 	if err != nil {
 		return err
 	}
@@ -258,19 +360,42 @@ func (ftr *FlowtupleReader) ReadRec(frec *FlowRec) error {
 	return nil
 }
 
+// ReadRecs fills dst with up to len(dst) records from the current
+// class, reusing each element's internal buffer so that callers
+// processing large files can avoid per-record allocation. It returns
+// the number of records read, which is less than len(dst) when the
+// class runs out first. It returns io.EOF when the class's key count
+// is reached before dst is full, even if it also returns n > 0; a
+// call that fills dst exactly returns nil, and the next call returns
+// 0, io.EOF.
+func (ftr *FlowtupleReader) ReadRecs(dst []FlowRec) (int, error) {
+	n := 0
+	for n < len(dst) {
+		if ftr.recnum >= ftr.keycnt {
+			return n, io.EOF
+		}
+		if err := dst[n].ReadFrom(ftr.br); err != nil {
+			return n, err
+		}
+		ftr.recnum++
+		n++
+	}
+	return n, nil
+}
+
 func (ftr *FlowtupleReader) ReadClassTail() error {
 
 	var magic uint32
-	err := binary.Read(ftr.r, binary.BigEndian, &magic)
+	err := binary.Read(ftr.br, binary.BigEndian, &magic)
 	if err != nil {
 		panic(err)
 	}
-	if magic != 0x53495854 {
+	if magic != magicClass {
 		return fmt.Errorf("Incorrect magic number %x", magic)
 	}
 
 	var classid2 uint16
-	err = binary.Read(ftr.r, binary.BigEndian, &classid2)
+	err = binary.Read(ftr.br, binary.BigEndian, &classid2)
 	if err != nil {
 		return err
 	}
@@ -285,16 +410,16 @@ func (ftr *FlowtupleReader) ReadIntervalTail() error {
 
 	// Should be interval magic number 0x494E5452
 	var magic uint32
-	err := binary.Read(ftr.r, binary.BigEndian, &magic)
+	err := binary.Read(ftr.br, binary.BigEndian, &magic)
 	if err != nil {
 		return err
 	}
-	if magic != 0x494e5452 {
+	if magic != magicInterval {
 		return fmt.Errorf("Incorrect magic number %x\n", magic)
 	}
 
 	var inum2 uint16
-	err = binary.Read(ftr.r, binary.BigEndian, &inum2)
+	err = binary.Read(ftr.br, binary.BigEndian, &inum2)
 	if err != nil {
 		return err
 	}
@@ -306,13 +431,242 @@ func (ftr *FlowtupleReader) ReadIntervalTail() error {
 	}
 
 	var iend uint32
-	err = binary.Read(ftr.r, binary.BigEndian, &iend)
+	err = binary.Read(ftr.br, binary.BigEndian, &iend)
 	if err != nil {
 		return err
 	}
 	if ftr.logger != nil {
 		ftr.logger.Printf("Interval end time: %v\n", iend)
 	}
+	ftr.iend = iend
+
+	return nil
+}
+
+// FlowtupleWriter emits a flowtuple stream in the format read by
+// FlowtupleReader. Calls must follow the same nested structure that
+// FlowtupleReader expects: WriteIntervalHead opens an interval,
+// WriteClassHead opens a class within it, WriteRec appends records up
+// to the count declared to WriteClassHead, and WriteClassTail /
+// WriteIntervalTail close what they opened. Close must be called
+// after the last interval to write the stream terminator.
+type FlowtupleWriter struct {
+
+	// Write flowtuples to this file
+	w io.Writer
+
+	// Buffered view of w used for all output
+	bw *bufio.Writer
+
+	// Current interval
+	inum int
+
+	// Current class id
+	classid int
+
+	// Declared and actual record counts for the open class
+	keycnt int
+	recnum int
+
+	// true between a WriteIntervalHead and its matching WriteIntervalTail
+	inInterval bool
+
+	// true between a WriteClassHead and its matching WriteClassTail
+	inClass bool
+}
+
+func NewFlowtupleWriter(w io.Writer) *FlowtupleWriter {
+
+	return &FlowtupleWriter{
+		w:  w,
+		bw: bufio.NewWriterSize(w, defaultBufSize),
+	}
+}
+
+func (ftw *FlowtupleWriter) writeUint16(v uint16) error {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	_, err := ftw.bw.Write(b[:])
+	return err
+}
+
+func (ftw *FlowtupleWriter) writeUint32(v uint32) error {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	_, err := ftw.bw.Write(b[:])
+	return err
+}
+
+// WriteIntervalHead opens a new interval with the given interval
+// number and start time.
+func (ftw *FlowtupleWriter) WriteIntervalHead(inum uint16, istart uint32) error {
+
+	if ftw.inInterval {
+		return fmt.Errorf("WriteIntervalHead called while interval %d is still open", ftw.inum)
+	}
+
+	if err := ftw.writeUint32(magicGlobal); err != nil {
+		return err
+	}
+	if err := ftw.writeUint32(magicInterval); err != nil {
+		return err
+	}
+	if err := ftw.writeUint16(inum); err != nil {
+		return err
+	}
+	if err := ftw.writeUint32(istart); err != nil {
+		return err
+	}
+
+	ftw.inum = int(inum)
+	ftw.inInterval = true
 
 	return nil
 }
+
+// WriteClassHead opens a new class of records within the current
+// interval. keycnt declares how many records WriteRec will be called
+// with before the matching WriteClassTail.
+func (ftw *FlowtupleWriter) WriteClassHead(classid uint16, keycnt uint32) error {
+
+	if !ftw.inInterval {
+		return fmt.Errorf("WriteClassHead called with no open interval")
+	}
+	if ftw.inClass {
+		return fmt.Errorf("WriteClassHead called while class %d is still open", ftw.classid)
+	}
+
+	if err := ftw.writeUint32(magicClass); err != nil {
+		return err
+	}
+	if err := ftw.writeUint16(classid); err != nil {
+		return err
+	}
+	if err := ftw.writeUint32(keycnt); err != nil {
+		return err
+	}
+
+	ftw.classid = int(classid)
+	ftw.keycnt = int(keycnt)
+	ftw.recnum = 0
+	ftw.inClass = true
+
+	return nil
+}
+
+// WriteRec appends one record to the current class.
+func (ftw *FlowtupleWriter) WriteRec(fr *FlowRec) error {
+
+	if !ftw.inClass {
+		return fmt.Errorf("WriteRec called with no open class")
+	}
+	if ftw.recnum >= ftw.keycnt {
+		return fmt.Errorf("class %d: WriteRec called more than the declared keycnt=%d", ftw.classid, ftw.keycnt)
+	}
+
+	srcb, err := addrTo4(fr.ResolvedSrcAddr())
+	if err != nil {
+		return fmt.Errorf("SrcAddr: %w", err)
+	}
+
+	// Only the top 3 octets of the destination address are stored on
+	// the wire.
+	dstb, err := addrTo4(fr.ResolvedDstAddr())
+	if err != nil {
+		return fmt.Errorf("DstAddr: %w", err)
+	}
+
+	var buf [recSize]byte
+	copy(buf[0:4], srcb[:])
+	copy(buf[4:7], dstb[0:3])
+
+	binary.BigEndian.PutUint16(buf[7:9], fr.SrcPort)
+	binary.BigEndian.PutUint16(buf[9:11], fr.DstPort)
+	buf[11] = fr.Protocol
+	buf[12] = fr.Flags
+	buf[13] = fr.Ttl
+	binary.BigEndian.PutUint16(buf[14:16], fr.IPLen)
+	binary.BigEndian.PutUint32(buf[16:20], fr.Count)
+
+	if _, err := ftw.bw.Write(buf[:]); err != nil {
+		return err
+	}
+	ftw.recnum++
+
+	return nil
+}
+
+// WriteClassTail closes the current class. It is an error to call
+// this before WriteRec has been called keycnt times.
+func (ftw *FlowtupleWriter) WriteClassTail() error {
+
+	if !ftw.inClass {
+		return fmt.Errorf("WriteClassTail called with no open class")
+	}
+	if ftw.recnum != ftw.keycnt {
+		return fmt.Errorf("class %d: wrote %d records, declared keycnt=%d", ftw.classid, ftw.recnum, ftw.keycnt)
+	}
+
+	if err := ftw.writeUint32(magicClass); err != nil {
+		return err
+	}
+	if err := ftw.writeUint16(uint16(ftw.classid)); err != nil {
+		return err
+	}
+
+	ftw.inClass = false
+
+	return nil
+}
+
+// WriteIntervalTail closes the current interval with its end time.
+func (ftw *FlowtupleWriter) WriteIntervalTail(iend uint32) error {
+
+	if ftw.inClass {
+		return fmt.Errorf("WriteIntervalTail called while class %d is still open", ftw.classid)
+	}
+	if !ftw.inInterval {
+		return fmt.Errorf("WriteIntervalTail called with no open interval")
+	}
+
+	// ReadClassHead consumes this leading magicGlobal itself, as the
+	// signal that there are no more classes in the interval; it is
+	// followed by the same magicInterval+inum+iend layout used by the
+	// interval head.
+	if err := ftw.writeUint32(magicGlobal); err != nil {
+		return err
+	}
+	if err := ftw.writeUint32(magicInterval); err != nil {
+		return err
+	}
+	if err := ftw.writeUint16(uint16(ftw.inum)); err != nil {
+		return err
+	}
+	if err := ftw.writeUint32(iend); err != nil {
+		return err
+	}
+
+	ftw.inInterval = false
+
+	return nil
+}
+
+// Close writes the stream terminator and flushes any buffered output.
+// It returns an error if an interval or class was left open.
+func (ftw *FlowtupleWriter) Close() error {
+
+	if ftw.inClass {
+		return fmt.Errorf("Close called while class %d is still open", ftw.classid)
+	}
+	if ftw.inInterval {
+		return fmt.Errorf("Close called while interval %d is still open", ftw.inum)
+	}
+
+	// Four zero bytes mark the end of the file, mirroring the magic=0
+	// case handled by ReadIntervalHead.
+	if err := ftw.writeUint32(0); err != nil {
+		return err
+	}
+
+	return ftw.bw.Flush()
+}
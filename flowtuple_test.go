@@ -1,9 +1,11 @@
 package flowtuple
 
 import (
+	"bytes"
 	"compress/gzip"
 	"io"
 	"log"
+	"net/netip"
 	"os"
 	"testing"
 )
@@ -75,3 +77,546 @@ func Test1(t *testing.T) {
 		}
 	}
 }
+
+// Test2 round-trips a small flowtuple stream through FlowtupleWriter
+// and FlowtupleReader.
+func Test2(t *testing.T) {
+
+	var buf bytes.Buffer
+	ftw := NewFlowtupleWriter(&buf)
+
+	if err := ftw.WriteIntervalHead(1, 1000); err != nil {
+		t.Fatalf("WriteIntervalHead failed: %v", err)
+	}
+
+	if err := ftw.WriteClassHead(2, 2); err != nil {
+		t.Fatalf("WriteClassHead failed: %v", err)
+	}
+
+	// DstAddr only has meaningful values in its top 3 octets: the wire
+	// format truncates the destination address to a /24.
+	recs := []FlowRec{
+		{SrcAddr: netip.MustParseAddr("1.2.3.4"), DstAddr: netip.MustParseAddr("5.6.7.0"), SrcPort: 80, DstPort: 443, Protocol: 6, Flags: 0x12, Ttl: 64, IPLen: 1500, Count: 10},
+		{SrcAddr: netip.MustParseAddr("10.11.12.13"), DstAddr: netip.MustParseAddr("15.16.0.0"), SrcPort: 53, DstPort: 12345, Protocol: 17, Flags: 0, Ttl: 32, IPLen: 60, Count: 1},
+	}
+	for i := range recs {
+		if err := ftw.WriteRec(&recs[i]); err != nil {
+			t.Fatalf("WriteRec failed: %v", err)
+		}
+	}
+
+	if err := ftw.WriteClassTail(); err != nil {
+		t.Fatalf("WriteClassTail failed: %v", err)
+	}
+	if err := ftw.WriteIntervalTail(2000); err != nil {
+		t.Fatalf("WriteIntervalTail failed: %v", err)
+	}
+	if err := ftw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	ftr := NewFlowtupleReader(&buf)
+
+	if err := ftr.ReadIntervalHead(); err != nil {
+		t.Fatalf("ReadIntervalHead failed: %v", err)
+	}
+	if ftr.Inum() != 1 {
+		t.Fatalf("Inum() = %d, want 1", ftr.Inum())
+	}
+
+	if err := ftr.ReadClassHead(); err != nil {
+		t.Fatalf("ReadClassHead failed: %v", err)
+	}
+	if ftr.ClassId() != 2 {
+		t.Fatalf("ClassId() = %d, want 2", ftr.ClassId())
+	}
+
+	var frec FlowRec
+	for i := range recs {
+		if err := ftr.ReadRec(&frec); err != nil {
+			t.Fatalf("ReadRec failed: %v", err)
+		}
+		if frec.SrcAddr != recs[i].SrcAddr || frec.DstAddr != recs[i].DstAddr {
+			t.Fatalf("record %d: got %+v, want %+v", i, frec, recs[i])
+		}
+	}
+	if err := ftr.ReadRec(&frec); err != io.EOF {
+		t.Fatalf("ReadRec after class exhausted: got %v, want io.EOF", err)
+	}
+
+	if err := ftr.ReadClassTail(); err != nil {
+		t.Fatalf("ReadClassTail failed: %v", err)
+	}
+	if err := ftr.ReadClassHead(); err != io.EOF {
+		t.Fatalf("ReadClassHead after last class: got %v, want io.EOF", err)
+	}
+	if err := ftr.ReadIntervalTail(); err != nil {
+		t.Fatalf("ReadIntervalTail failed: %v", err)
+	}
+
+	if err := ftr.ReadIntervalHead(); err != io.EOF {
+		t.Fatalf("final ReadIntervalHead: got %v, want io.EOF", err)
+	}
+}
+
+// Test3 builds an index over a small flowtuple stream, round-trips it
+// through Save/LoadIndex, and uses it to seek directly to a class.
+func Test3(t *testing.T) {
+
+	var buf bytes.Buffer
+	ftw := NewFlowtupleWriter(&buf)
+
+	write := func(inum uint16, classid uint16, n uint32) {
+		if err := ftw.WriteIntervalHead(inum, uint32(inum)*1000); err != nil {
+			t.Fatalf("WriteIntervalHead failed: %v", err)
+		}
+		if err := ftw.WriteClassHead(classid, n); err != nil {
+			t.Fatalf("WriteClassHead failed: %v", err)
+		}
+		var fr FlowRec
+		for i := uint32(0); i < n; i++ {
+			fr.Count = i
+			if err := ftw.WriteRec(&fr); err != nil {
+				t.Fatalf("WriteRec failed: %v", err)
+			}
+		}
+		if err := ftw.WriteClassTail(); err != nil {
+			t.Fatalf("WriteClassTail failed: %v", err)
+		}
+		if err := ftw.WriteIntervalTail(uint32(inum)*1000 + 1); err != nil {
+			t.Fatalf("WriteIntervalTail failed: %v", err)
+		}
+	}
+
+	write(1, 10, 2)
+	write(2, 20, 3)
+
+	if err := ftw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	src := bytes.NewReader(buf.Bytes())
+
+	idx, err := BuildIndex(src)
+	if err != nil {
+		t.Fatalf("BuildIndex failed: %v", err)
+	}
+
+	var saved bytes.Buffer
+	if err := idx.Save(&saved); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	idx2, err := LoadIndex(bytes.NewReader(saved.Bytes()))
+	if err != nil {
+		t.Fatalf("LoadIndex failed: %v", err)
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	ftr := NewFlowtupleReader(src).UseIndex(idx2)
+
+	if err := ftr.SeekClass(2, 20); err != nil {
+		t.Fatalf("SeekClass failed: %v", err)
+	}
+	if ftr.IntervalStart() != 2000 {
+		t.Fatalf("IntervalStart() = %d, want 2000", ftr.IntervalStart())
+	}
+	if err := ftr.ReadClassHead(); err != nil {
+		t.Fatalf("ReadClassHead failed: %v", err)
+	}
+	if ftr.ClassId() != 20 {
+		t.Fatalf("ClassId() = %d, want 20", ftr.ClassId())
+	}
+
+	var frec FlowRec
+	n := 0
+	for {
+		if err := ftr.ReadRec(&frec); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("ReadRec failed: %v", err)
+		}
+		n++
+	}
+	if n != 3 {
+		t.Fatalf("read %d records, want 3", n)
+	}
+}
+
+// Test4 exercises the Records iterator over a small flowtuple stream.
+func Test4(t *testing.T) {
+
+	var buf bytes.Buffer
+	ftw := NewFlowtupleWriter(&buf)
+
+	if err := ftw.WriteIntervalHead(1, 1000); err != nil {
+		t.Fatalf("WriteIntervalHead failed: %v", err)
+	}
+	if err := ftw.WriteClassHead(2, 2); err != nil {
+		t.Fatalf("WriteClassHead failed: %v", err)
+	}
+	var fr FlowRec
+	for i := uint32(0); i < 2; i++ {
+		fr.Count = i
+		if err := ftw.WriteRec(&fr); err != nil {
+			t.Fatalf("WriteRec failed: %v", err)
+		}
+	}
+	if err := ftw.WriteClassTail(); err != nil {
+		t.Fatalf("WriteClassTail failed: %v", err)
+	}
+	if err := ftw.WriteIntervalTail(2000); err != nil {
+		t.Fatalf("WriteIntervalTail failed: %v", err)
+	}
+	if err := ftw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	ftr := NewFlowtupleReader(&buf)
+
+	var got []uint32
+	for ctx, err := range ftr.Records() {
+		if err != nil {
+			t.Fatalf("Records failed: %v", err)
+		}
+		if ctx.Inum != 1 || ctx.ClassId != 2 || ctx.IntervalStart != 1000 {
+			t.Fatalf("unexpected context: %+v", ctx)
+		}
+		got = append(got, ctx.Rec.Count)
+	}
+
+	if len(got) != 2 || got[0] != 0 || got[1] != 1 {
+		t.Fatalf("got %v, want [0 1]", got)
+	}
+}
+
+// Test5 exercises ReadRecs, including a partial fill at a class
+// boundary that returns io.EOF alongside n > 0.
+func Test5(t *testing.T) {
+
+	var buf bytes.Buffer
+	ftw := NewFlowtupleWriter(&buf)
+
+	if err := ftw.WriteIntervalHead(1, 1000); err != nil {
+		t.Fatalf("WriteIntervalHead failed: %v", err)
+	}
+	if err := ftw.WriteClassHead(2, 5); err != nil {
+		t.Fatalf("WriteClassHead failed: %v", err)
+	}
+	var fr FlowRec
+	for i := uint32(0); i < 5; i++ {
+		fr.Count = i
+		if err := ftw.WriteRec(&fr); err != nil {
+			t.Fatalf("WriteRec failed: %v", err)
+		}
+	}
+	if err := ftw.WriteClassTail(); err != nil {
+		t.Fatalf("WriteClassTail failed: %v", err)
+	}
+	if err := ftw.WriteIntervalTail(2000); err != nil {
+		t.Fatalf("WriteIntervalTail failed: %v", err)
+	}
+	if err := ftw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	ftr := NewFlowtupleReader(&buf)
+
+	if err := ftr.ReadIntervalHead(); err != nil {
+		t.Fatalf("ReadIntervalHead failed: %v", err)
+	}
+	if err := ftr.ReadClassHead(); err != nil {
+		t.Fatalf("ReadClassHead failed: %v", err)
+	}
+
+	dst := make([]FlowRec, 3)
+
+	n, err := ftr.ReadRecs(dst)
+	if err != nil {
+		t.Fatalf("ReadRecs failed: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("n = %d, want 3", n)
+	}
+	for i := 0; i < 3; i++ {
+		if dst[i].Count != uint32(i) {
+			t.Fatalf("record %d: Count = %d, want %d", i, dst[i].Count, i)
+		}
+	}
+
+	// The class has 5 records total; filling a 3-element slice a
+	// second time crosses the class boundary after 2, and ReadRecs
+	// must report io.EOF alongside the partial n it did fill.
+	n, err = ftr.ReadRecs(dst)
+	if err != io.EOF {
+		t.Fatalf("err = %v, want io.EOF", err)
+	}
+	if n != 2 {
+		t.Fatalf("n = %d, want 2", n)
+	}
+	if dst[0].Count != 3 || dst[1].Count != 4 {
+		t.Fatalf("got Count %d, %d; want 3, 4", dst[0].Count, dst[1].Count)
+	}
+}
+
+// Test6 checks that FlowtupleWriter rejects calls made out of order.
+func Test6(t *testing.T) {
+
+	t.Run("WriteRec with no open class", func(t *testing.T) {
+		var buf bytes.Buffer
+		ftw := NewFlowtupleWriter(&buf)
+		if err := ftw.WriteIntervalHead(1, 1000); err != nil {
+			t.Fatalf("WriteIntervalHead failed: %v", err)
+		}
+		var fr FlowRec
+		if err := ftw.WriteRec(&fr); err == nil {
+			t.Fatalf("WriteRec with no open class: got nil error")
+		}
+	})
+
+	t.Run("WriteClassTail with too few records", func(t *testing.T) {
+		var buf bytes.Buffer
+		ftw := NewFlowtupleWriter(&buf)
+		if err := ftw.WriteIntervalHead(1, 1000); err != nil {
+			t.Fatalf("WriteIntervalHead failed: %v", err)
+		}
+		if err := ftw.WriteClassHead(2, 2); err != nil {
+			t.Fatalf("WriteClassHead failed: %v", err)
+		}
+		var fr FlowRec
+		if err := ftw.WriteRec(&fr); err != nil {
+			t.Fatalf("WriteRec failed: %v", err)
+		}
+		if err := ftw.WriteClassTail(); err == nil {
+			t.Fatalf("WriteClassTail with 1 of 2 declared records: got nil error")
+		}
+	})
+
+	t.Run("WriteRec past declared keycnt", func(t *testing.T) {
+		var buf bytes.Buffer
+		ftw := NewFlowtupleWriter(&buf)
+		if err := ftw.WriteIntervalHead(1, 1000); err != nil {
+			t.Fatalf("WriteIntervalHead failed: %v", err)
+		}
+		if err := ftw.WriteClassHead(2, 1); err != nil {
+			t.Fatalf("WriteClassHead failed: %v", err)
+		}
+		var fr FlowRec
+		if err := ftw.WriteRec(&fr); err != nil {
+			t.Fatalf("WriteRec failed: %v", err)
+		}
+		if err := ftw.WriteRec(&fr); err == nil {
+			t.Fatalf("WriteRec past declared keycnt=1: got nil error")
+		}
+	})
+
+	t.Run("WriteIntervalTail with class still open", func(t *testing.T) {
+		var buf bytes.Buffer
+		ftw := NewFlowtupleWriter(&buf)
+		if err := ftw.WriteIntervalHead(1, 1000); err != nil {
+			t.Fatalf("WriteIntervalHead failed: %v", err)
+		}
+		if err := ftw.WriteClassHead(2, 0); err != nil {
+			t.Fatalf("WriteClassHead failed: %v", err)
+		}
+		if err := ftw.WriteIntervalTail(2000); err == nil {
+			t.Fatalf("WriteIntervalTail with class still open: got nil error")
+		}
+	})
+
+	t.Run("Close with interval still open", func(t *testing.T) {
+		var buf bytes.Buffer
+		ftw := NewFlowtupleWriter(&buf)
+		if err := ftw.WriteIntervalHead(1, 1000); err != nil {
+			t.Fatalf("WriteIntervalHead failed: %v", err)
+		}
+		if err := ftw.Close(); err == nil {
+			t.Fatalf("Close with interval still open: got nil error")
+		}
+	})
+
+	t.Run("Close with class still open", func(t *testing.T) {
+		var buf bytes.Buffer
+		ftw := NewFlowtupleWriter(&buf)
+		if err := ftw.WriteIntervalHead(1, 1000); err != nil {
+			t.Fatalf("WriteIntervalHead failed: %v", err)
+		}
+		if err := ftw.WriteClassHead(2, 0); err != nil {
+			t.Fatalf("WriteClassHead failed: %v", err)
+		}
+		if err := ftw.Close(); err == nil {
+			t.Fatalf("Close with class still open: got nil error")
+		}
+	})
+
+	t.Run("WriteRec with non-IPv4 address", func(t *testing.T) {
+		var buf bytes.Buffer
+		ftw := NewFlowtupleWriter(&buf)
+		if err := ftw.WriteIntervalHead(1, 1000); err != nil {
+			t.Fatalf("WriteIntervalHead failed: %v", err)
+		}
+		if err := ftw.WriteClassHead(2, 1); err != nil {
+			t.Fatalf("WriteClassHead failed: %v", err)
+		}
+		fr := FlowRec{SrcAddr: netip.MustParseAddr("::1"), DstAddr: netip.MustParseAddr("1.2.3.4")}
+		if err := ftw.WriteRec(&fr); err == nil {
+			t.Fatalf("WriteRec with an IPv6 SrcAddr: got nil error")
+		}
+	})
+}
+
+// Test7 exercises SeekInterval, and checks that both SeekInterval and
+// SeekClass reject an index that no longer matches the size of the
+// file it was built from.
+func Test7(t *testing.T) {
+
+	var buf bytes.Buffer
+	ftw := NewFlowtupleWriter(&buf)
+
+	write := func(inum uint16, classid uint16, n uint32) {
+		if err := ftw.WriteIntervalHead(inum, uint32(inum)*1000); err != nil {
+			t.Fatalf("WriteIntervalHead failed: %v", err)
+		}
+		if err := ftw.WriteClassHead(classid, n); err != nil {
+			t.Fatalf("WriteClassHead failed: %v", err)
+		}
+		var fr FlowRec
+		for i := uint32(0); i < n; i++ {
+			fr.Count = i
+			if err := ftw.WriteRec(&fr); err != nil {
+				t.Fatalf("WriteRec failed: %v", err)
+			}
+		}
+		if err := ftw.WriteClassTail(); err != nil {
+			t.Fatalf("WriteClassTail failed: %v", err)
+		}
+		if err := ftw.WriteIntervalTail(uint32(inum)*1000 + 1); err != nil {
+			t.Fatalf("WriteIntervalTail failed: %v", err)
+		}
+	}
+
+	write(1, 10, 2)
+	write(2, 20, 3)
+
+	if err := ftw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	fid, err := os.CreateTemp("", "flowtuple-index-*")
+	if err != nil {
+		t.Fatalf("CreateTemp failed: %v", err)
+	}
+	defer os.Remove(fid.Name())
+	defer fid.Close()
+
+	if _, err := fid.Write(buf.Bytes()); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := fid.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+
+	idx, err := BuildIndex(fid)
+	if err != nil {
+		t.Fatalf("BuildIndex failed: %v", err)
+	}
+
+	if _, err := fid.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	ftr := NewFlowtupleReader(fid).UseIndex(idx)
+
+	if err := ftr.SeekInterval(2); err != nil {
+		t.Fatalf("SeekInterval failed: %v", err)
+	}
+	if err := ftr.ReadIntervalHead(); err != nil {
+		t.Fatalf("ReadIntervalHead failed: %v", err)
+	}
+	if ftr.Inum() != 2 || ftr.IntervalStart() != 2000 {
+		t.Fatalf("Inum()=%d IntervalStart()=%d, want 2, 2000", ftr.Inum(), ftr.IntervalStart())
+	}
+
+	// Append a byte, making the file disagree with the index's recorded
+	// size.
+	if _, err := fid.Write([]byte{0}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	if err := ftr.SeekInterval(1); err == nil {
+		t.Fatalf("SeekInterval against a stale index: got nil error")
+	}
+	if err := ftr.SeekClass(1, 10); err == nil {
+		t.Fatalf("SeekClass against a stale index: got nil error")
+	}
+}
+
+// recordingExporter is a minimal Exporter used to verify Convert's call
+// sequence and that it hands every record through unmodified.
+type recordingExporter struct {
+	header bool
+	closed bool
+	counts []uint32
+}
+
+func (e *recordingExporter) WriteHeader() error {
+	e.header = true
+	return nil
+}
+
+func (e *recordingExporter) WriteRecord(ctx RecordContext, rec *FlowRec) error {
+	e.counts = append(e.counts, rec.Count)
+	return nil
+}
+
+func (e *recordingExporter) Close() error {
+	e.closed = true
+	return nil
+}
+
+// Test8 exercises Convert end-to-end against a FlowtupleWriter-produced
+// stream.
+func Test8(t *testing.T) {
+
+	var buf bytes.Buffer
+	ftw := NewFlowtupleWriter(&buf)
+
+	if err := ftw.WriteIntervalHead(1, 1000); err != nil {
+		t.Fatalf("WriteIntervalHead failed: %v", err)
+	}
+	if err := ftw.WriteClassHead(2, 2); err != nil {
+		t.Fatalf("WriteClassHead failed: %v", err)
+	}
+	var fr FlowRec
+	for i := uint32(0); i < 2; i++ {
+		fr.Count = i
+		if err := ftw.WriteRec(&fr); err != nil {
+			t.Fatalf("WriteRec failed: %v", err)
+		}
+	}
+	if err := ftw.WriteClassTail(); err != nil {
+		t.Fatalf("WriteClassTail failed: %v", err)
+	}
+	if err := ftw.WriteIntervalTail(2000); err != nil {
+		t.Fatalf("WriteIntervalTail failed: %v", err)
+	}
+	if err := ftw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	var e recordingExporter
+	if err := Convert(&buf, &e); err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	if !e.header {
+		t.Fatalf("Convert did not call WriteHeader")
+	}
+	if !e.closed {
+		t.Fatalf("Convert did not call Close")
+	}
+	if len(e.counts) != 2 || e.counts[0] != 0 || e.counts[1] != 1 {
+		t.Fatalf("got %v, want [0 1]", e.counts)
+	}
+}
@@ -0,0 +1,426 @@
+// Index support for random access to a flowtuple file.
+//
+// BuildIndex scans a file once, recording the byte offset of every
+// interval and class header. The resulting Index can be saved to and
+// loaded from a sidecar file with Save/LoadIndex, and attached to a
+// FlowtupleReader with UseIndex to jump directly to a given interval
+// or class with SeekInterval/SeekClass instead of re-parsing the
+// file from the start.
+
+package flowtuple
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// Magic number and version prefixing a saved index.
+const (
+	indexMagic   uint32 = 0x46544958 // "FTIX"
+	indexVersion uint16 = 1
+)
+
+// indexKey identifies a class header within an interval.
+type indexKey struct {
+	inum    int
+	classid int
+}
+
+// Index records the byte offset of every interval and class header in
+// a flowtuple file.
+type Index struct {
+
+	// intervals maps an interval number to the file offset of its
+	// interval header.
+	intervals map[int]int64
+
+	// classes maps an (interval, class id) pair to the file offset of
+	// its class header.
+	classes map[indexKey]int64
+
+	// size is the length in bytes of the file the index was built
+	// from, used to detect a stale index in checkSize.
+	size int64
+}
+
+// BuildIndex scans a flowtuple file once, recording the offset of
+// every interval header and every (interval, class id) class header.
+// It leaves r positioned at the end of the file.
+func BuildIndex(r io.ReadSeeker) (*Index, error) {
+
+	idx := &Index{
+		intervals: make(map[int]int64),
+		classes:   make(map[indexKey]int64),
+	}
+
+	for {
+		ipos, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+
+		var magic uint32
+		if err := binary.Read(r, binary.BigEndian, &magic); err != nil {
+			return nil, err
+		}
+		if magic == 0 {
+			break
+		}
+		if magic != magicGlobal {
+			return nil, fmt.Errorf("Incorrect magic number %x", magic)
+		}
+
+		if err := binary.Read(r, binary.BigEndian, &magic); err != nil {
+			return nil, err
+		}
+		if magic != magicInterval {
+			return nil, fmt.Errorf("Incorrect magic number %x", magic)
+		}
+
+		var inum uint16
+		if err := binary.Read(r, binary.BigEndian, &inum); err != nil {
+			return nil, err
+		}
+		var istart uint32
+		if err := binary.Read(r, binary.BigEndian, &istart); err != nil {
+			return nil, err
+		}
+		idx.intervals[int(inum)] = ipos
+
+		for {
+			cpos, err := r.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+
+			var cmagic uint32
+			if err := binary.Read(r, binary.BigEndian, &cmagic); err != nil {
+				return nil, err
+			}
+			if cmagic == magicGlobal {
+				// No more classes in this interval: what follows is
+				// the interval tail, in the same magicInterval+inum+
+				// time layout as the interval head.
+				var timagic uint32
+				if err := binary.Read(r, binary.BigEndian, &timagic); err != nil {
+					return nil, err
+				}
+				if timagic != magicInterval {
+					return nil, fmt.Errorf("Incorrect magic number %x", timagic)
+				}
+				var inum2 uint16
+				if err := binary.Read(r, binary.BigEndian, &inum2); err != nil {
+					return nil, err
+				}
+				if inum2 != inum {
+					return nil, fmt.Errorf("Incorrect interval number %d != %d", inum, inum2)
+				}
+				var iend uint32
+				if err := binary.Read(r, binary.BigEndian, &iend); err != nil {
+					return nil, err
+				}
+				break
+			}
+			if cmagic != magicClass {
+				return nil, fmt.Errorf("Incorrect magic number %x", cmagic)
+			}
+
+			var classid uint16
+			if err := binary.Read(r, binary.BigEndian, &classid); err != nil {
+				return nil, err
+			}
+			var keycnt uint32
+			if err := binary.Read(r, binary.BigEndian, &keycnt); err != nil {
+				return nil, err
+			}
+			idx.classes[indexKey{inum: int(inum), classid: int(classid)}] = cpos
+
+			// Skip the records themselves; the index only needs the
+			// header offsets.
+			if _, err := r.Seek(int64(keycnt)*recSize, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+
+			var tmagic uint32
+			if err := binary.Read(r, binary.BigEndian, &tmagic); err != nil {
+				return nil, err
+			}
+			if tmagic != magicClass {
+				return nil, fmt.Errorf("Incorrect magic number %x", tmagic)
+			}
+			var classid2 uint16
+			if err := binary.Read(r, binary.BigEndian, &classid2); err != nil {
+				return nil, err
+			}
+			if classid2 != classid {
+				return nil, fmt.Errorf("Incorrect class id: %d != %d", classid, classid2)
+			}
+		}
+	}
+
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	idx.size = size
+
+	return idx, nil
+}
+
+// Save writes the index in a compact binary form: a magic number and
+// version, the payload, and a trailing CRC32 of the payload.
+func (idx *Index) Save(w io.Writer) error {
+
+	var payload bytes.Buffer
+
+	if err := binary.Write(&payload, binary.BigEndian, idx.size); err != nil {
+		return err
+	}
+
+	inums := make([]int, 0, len(idx.intervals))
+	for inum := range idx.intervals {
+		inums = append(inums, inum)
+	}
+	sort.Ints(inums)
+
+	if err := binary.Write(&payload, binary.BigEndian, uint32(len(inums))); err != nil {
+		return err
+	}
+	for _, inum := range inums {
+		if err := binary.Write(&payload, binary.BigEndian, uint16(inum)); err != nil {
+			return err
+		}
+		if err := binary.Write(&payload, binary.BigEndian, idx.intervals[inum]); err != nil {
+			return err
+		}
+	}
+
+	keys := make([]indexKey, 0, len(idx.classes))
+	for k := range idx.classes {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].inum != keys[j].inum {
+			return keys[i].inum < keys[j].inum
+		}
+		return keys[i].classid < keys[j].classid
+	})
+
+	if err := binary.Write(&payload, binary.BigEndian, uint32(len(keys))); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := binary.Write(&payload, binary.BigEndian, uint16(k.inum)); err != nil {
+			return err
+		}
+		if err := binary.Write(&payload, binary.BigEndian, uint16(k.classid)); err != nil {
+			return err
+		}
+		if err := binary.Write(&payload, binary.BigEndian, idx.classes[k]); err != nil {
+			return err
+		}
+	}
+
+	if err := binary.Write(w, binary.BigEndian, indexMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, indexVersion); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload.Bytes()); err != nil {
+		return err
+	}
+
+	crc := crc32.ChecksumIEEE(payload.Bytes())
+	return binary.Write(w, binary.BigEndian, crc)
+}
+
+// LoadIndex reads an index previously written by (*Index).Save,
+// verifying its magic number, version, and trailing CRC32.
+func LoadIndex(r io.Reader) (*Index, error) {
+
+	var magic uint32
+	if err := binary.Read(r, binary.BigEndian, &magic); err != nil {
+		return nil, err
+	}
+	if magic != indexMagic {
+		return nil, fmt.Errorf("Incorrect index magic number %x", magic)
+	}
+
+	var version uint16
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, err
+	}
+	if version != indexVersion {
+		return nil, fmt.Errorf("Unsupported index version %d", version)
+	}
+
+	payload, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < 4 {
+		return nil, fmt.Errorf("Truncated index")
+	}
+
+	body := payload[:len(payload)-4]
+	wantCRC := binary.BigEndian.Uint32(payload[len(payload)-4:])
+	if crc := crc32.ChecksumIEEE(body); crc != wantCRC {
+		return nil, fmt.Errorf("Index CRC mismatch: %x != %x", crc, wantCRC)
+	}
+
+	br := bytes.NewReader(body)
+
+	idx := &Index{
+		intervals: make(map[int]int64),
+		classes:   make(map[indexKey]int64),
+	}
+
+	if err := binary.Read(br, binary.BigEndian, &idx.size); err != nil {
+		return nil, err
+	}
+
+	var nintervals uint32
+	if err := binary.Read(br, binary.BigEndian, &nintervals); err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < nintervals; i++ {
+		var inum uint16
+		var off int64
+		if err := binary.Read(br, binary.BigEndian, &inum); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(br, binary.BigEndian, &off); err != nil {
+			return nil, err
+		}
+		idx.intervals[int(inum)] = off
+	}
+
+	var nclasses uint32
+	if err := binary.Read(br, binary.BigEndian, &nclasses); err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < nclasses; i++ {
+		var inum, classid uint16
+		var off int64
+		if err := binary.Read(br, binary.BigEndian, &inum); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(br, binary.BigEndian, &classid); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(br, binary.BigEndian, &off); err != nil {
+			return nil, err
+		}
+		idx.classes[indexKey{inum: int(inum), classid: int(classid)}] = off
+	}
+
+	return idx, nil
+}
+
+// checkSize rejects an index that was not built from the file
+// currently behind rs, analogous to the topPos check used to detect a
+// stale ZODB index save file.
+func (idx *Index) checkSize(rs io.ReadSeeker) error {
+
+	cur, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := rs.Seek(cur, io.SeekStart); err != nil {
+		return err
+	}
+
+	if size != idx.size {
+		return fmt.Errorf("index was built for a %d-byte file, but the current file is %d bytes", idx.size, size)
+	}
+
+	return nil
+}
+
+// UseIndex attaches idx to ftr, enabling SeekInterval and SeekClass.
+func (ftr *FlowtupleReader) UseIndex(idx *Index) *FlowtupleReader {
+	ftr.idx = idx
+	return ftr
+}
+
+// SeekInterval positions ftr so that the next call to ReadIntervalHead
+// reads interval inum. It requires that ftr was constructed over an
+// io.ReadSeeker and that an index has been attached with UseIndex.
+func (ftr *FlowtupleReader) SeekInterval(inum int) error {
+
+	rs, ok := ftr.r.(io.ReadSeeker)
+	if !ok {
+		return fmt.Errorf("SeekInterval requires an io.ReadSeeker source")
+	}
+	if ftr.idx == nil {
+		return fmt.Errorf("SeekInterval requires an attached index; call UseIndex first")
+	}
+	if err := ftr.idx.checkSize(rs); err != nil {
+		return err
+	}
+
+	off, ok := ftr.idx.intervals[inum]
+	if !ok {
+		return fmt.Errorf("no interval %d in index", inum)
+	}
+	if _, err := rs.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	ftr.br.Reset(rs)
+
+	return nil
+}
+
+// SeekClass positions ftr so that the next call to ReadClassHead reads
+// class classid of interval inum, without visiting the classes before
+// it. As with SeekInterval, it requires an io.ReadSeeker source and an
+// attached index.
+func (ftr *FlowtupleReader) SeekClass(inum, classid int) error {
+
+	rs, ok := ftr.r.(io.ReadSeeker)
+	if !ok {
+		return fmt.Errorf("SeekClass requires an io.ReadSeeker source")
+	}
+	if ftr.idx == nil {
+		return fmt.Errorf("SeekClass requires an attached index; call UseIndex first")
+	}
+	if err := ftr.idx.checkSize(rs); err != nil {
+		return err
+	}
+
+	off, ok := ftr.idx.classes[indexKey{inum: inum, classid: classid}]
+	if !ok {
+		return fmt.Errorf("no class %d in interval %d in index", classid, inum)
+	}
+	ivoff, ok := ftr.idx.intervals[inum]
+	if !ok {
+		return fmt.Errorf("no interval %d in index", inum)
+	}
+
+	// Read the interval head first, purely to populate IntervalStart;
+	// it is otherwise redundant with the seek below.
+	if _, err := rs.Seek(ivoff, io.SeekStart); err != nil {
+		return err
+	}
+	ftr.br.Reset(rs)
+	if err := ftr.ReadIntervalHead(); err != nil {
+		return err
+	}
+
+	if _, err := rs.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	ftr.br.Reset(rs)
+	ftr.inum = inum
+
+	return nil
+}
@@ -0,0 +1,64 @@
+// Package jsonexp implements flowtuple.Exporter, writing records as
+// newline-delimited JSON (NDJSON), one record per line.
+package jsonexp
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/kshedden/flowtuple"
+)
+
+// Exporter writes flowtuple records as NDJSON.
+type Exporter struct {
+	enc *json.Encoder
+}
+
+// New returns an Exporter that writes NDJSON to w.
+func New(w io.Writer) *Exporter {
+	return &Exporter{enc: json.NewEncoder(w)}
+}
+
+// jsonRecord is the JSON representation of one flowtuple record.
+type jsonRecord struct {
+	Inum          int    `json:"inum"`
+	ClassId       int    `json:"classid"`
+	IntervalStart uint32 `json:"interval_start"`
+	SrcIP         string `json:"src_ip"`
+	DstIP         string `json:"dst_ip"`
+	SrcPort       uint16 `json:"src_port"`
+	DstPort       uint16 `json:"dst_port"`
+	Protocol      uint8  `json:"protocol"`
+	Flags         uint8  `json:"flags"`
+	Ttl           uint8  `json:"ttl"`
+	IPLen         uint16 `json:"ip_len"`
+	Count         uint32 `json:"count"`
+}
+
+// WriteHeader is a no-op; NDJSON has no header.
+func (e *Exporter) WriteHeader() error {
+	return nil
+}
+
+// WriteRecord writes one record as a JSON line.
+func (e *Exporter) WriteRecord(ctx flowtuple.RecordContext, rec *flowtuple.FlowRec) error {
+	return e.enc.Encode(jsonRecord{
+		Inum:          ctx.Inum,
+		ClassId:       ctx.ClassId,
+		IntervalStart: ctx.IntervalStart,
+		SrcIP:         rec.ResolvedSrcAddr().String(),
+		DstIP:         rec.ResolvedDstAddr().String(),
+		SrcPort:       rec.SrcPort,
+		DstPort:       rec.DstPort,
+		Protocol:      rec.Protocol,
+		Flags:         rec.Flags,
+		Ttl:           rec.Ttl,
+		IPLen:         rec.IPLen,
+		Count:         rec.Count,
+	})
+}
+
+// Close is a no-op; the caller owns the underlying writer.
+func (e *Exporter) Close() error {
+	return nil
+}
@@ -0,0 +1,63 @@
+package jsonexp
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/netip"
+	"testing"
+
+	"github.com/kshedden/flowtuple"
+)
+
+func TestExporter(t *testing.T) {
+
+	var buf bytes.Buffer
+	e := New(&buf)
+
+	if err := e.WriteHeader(); err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+
+	rec := &flowtuple.FlowRec{SrcAddr: netip.MustParseAddr("1.2.3.4"), DstAddr: netip.MustParseAddr("5.6.7.0"), SrcPort: 80, DstPort: 443, Protocol: 6, Count: 7}
+	ctx := flowtuple.RecordContext{Inum: 1, ClassId: 2, IntervalStart: 1000, Rec: rec}
+
+	if err := e.WriteRecord(ctx, rec); err != nil {
+		t.Fatalf("WriteRecord failed: %v", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	var got jsonRecord
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	if got.SrcIP != "1.2.3.4" || got.DstIP != "5.6.7.0" || got.Count != 7 || got.Inum != 1 || got.ClassId != 2 {
+		t.Fatalf("unexpected record: %+v", got)
+	}
+}
+
+// TestExporterLegacyFields checks that a FlowRec built with only the
+// deprecated SrcIP/DstIP fields still exports the right addresses,
+// rather than silently writing "invalid IP".
+func TestExporterLegacyFields(t *testing.T) {
+
+	var buf bytes.Buffer
+	e := New(&buf)
+
+	rec := &flowtuple.FlowRec{SrcIP: 0x01020304, DstIP: 0x05060700, SrcPort: 80, DstPort: 443, Protocol: 6}
+	ctx := flowtuple.RecordContext{Rec: rec}
+
+	if err := e.WriteRecord(ctx, rec); err != nil {
+		t.Fatalf("WriteRecord failed: %v", err)
+	}
+
+	var got jsonRecord
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if got.SrcIP != "1.2.3.4" || got.DstIP != "5.6.7.0" {
+		t.Fatalf("got %+v, want src 1.2.3.4 dst 5.6.7.0", got)
+	}
+}
@@ -0,0 +1,90 @@
+package pcapexp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/kshedden/flowtuple"
+)
+
+func TestExporter(t *testing.T) {
+
+	var buf bytes.Buffer
+	e := New(&buf)
+
+	if err := e.WriteHeader(); err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+
+	rec := &flowtuple.FlowRec{SrcAddr: netip.MustParseAddr("1.2.3.4"), DstAddr: netip.MustParseAddr("5.6.7.0"), SrcPort: 80, DstPort: 443, Protocol: 6, Ttl: 64, Count: 3}
+	ctx := flowtuple.RecordContext{Inum: 1, ClassId: 2, Rec: rec}
+
+	if err := e.WriteRecord(ctx, rec); err != nil {
+		t.Fatalf("WriteRecord failed: %v", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	data := buf.Bytes()
+	if len(data) != 24+16+(ipHeaderLen+20) {
+		t.Fatalf("got %d bytes, want %d", len(data), 24+16+(ipHeaderLen+20))
+	}
+
+	if magic := binary.LittleEndian.Uint32(data[0:4]); magic != pcapMagic {
+		t.Fatalf("bad pcap magic: %x", magic)
+	}
+	if linktype := binary.LittleEndian.Uint32(data[20:24]); linktype != linkTypeRaw {
+		t.Fatalf("bad linktype: %d", linktype)
+	}
+
+	pkt := data[24+16:]
+	if pkt[0] != 0x45 {
+		t.Fatalf("bad IP version/IHL byte: %#x", pkt[0])
+	}
+	if pkt[9] != 6 {
+		t.Fatalf("bad protocol: %d", pkt[9])
+	}
+	wantSrc, _ := netip.AddrFromSlice(pkt[12:16])
+	if wantSrc != rec.SrcAddr {
+		t.Fatalf("bad src ip: %v", wantSrc)
+	}
+	wantDst, _ := netip.AddrFromSlice(pkt[16:20])
+	if wantDst != rec.DstAddr {
+		t.Fatalf("bad dst ip: %v", wantDst)
+	}
+	if ipChecksum(pkt[:ipHeaderLen]) != 0 {
+		t.Fatalf("bad IP checksum")
+	}
+}
+
+// TestExporterLegacyFields checks that a FlowRec built with only the
+// deprecated SrcIP/DstIP fields still synthesizes the right packet,
+// rather than a garbage/zero-address one.
+func TestExporterLegacyFields(t *testing.T) {
+
+	var buf bytes.Buffer
+	e := New(&buf)
+
+	rec := &flowtuple.FlowRec{SrcIP: 0x01020304, DstIP: 0x05060700, SrcPort: 80, DstPort: 443, Protocol: 17}
+	ctx := flowtuple.RecordContext{Rec: rec}
+
+	if err := e.WriteHeader(); err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+	if err := e.WriteRecord(ctx, rec); err != nil {
+		t.Fatalf("WriteRecord failed: %v", err)
+	}
+
+	pkt := buf.Bytes()[24+16:]
+	wantSrc, _ := netip.AddrFromSlice(pkt[12:16])
+	if wantSrc.String() != "1.2.3.4" {
+		t.Fatalf("bad src ip: %v", wantSrc)
+	}
+	wantDst, _ := netip.AddrFromSlice(pkt[16:20])
+	if wantDst.String() != "5.6.7.0" {
+		t.Fatalf("bad dst ip: %v", wantDst)
+	}
+}
@@ -0,0 +1,98 @@
+// Records provides the documented, high-level entry point for reading
+// a flowtuple file: a single range-over-func loop in place of the
+// triple-nested ReadIntervalHead/ReadClassHead/ReadRec/ReadClassTail/
+// ReadIntervalTail loop that every caller otherwise has to write.
+
+package flowtuple
+
+import (
+	"io"
+	"iter"
+)
+
+// RecordContext carries the interval and class that a record yielded
+// by Records belongs to, along with a pointer to the record itself.
+type RecordContext struct {
+
+	// Interval number of Rec
+	Inum int
+
+	// Class id of Rec
+	ClassId int
+
+	// Start time of the interval containing Rec
+	IntervalStart uint32
+
+	// End time of the interval containing Rec. This is only known
+	// once the interval has closed, so it reads as 0 for every record
+	// observed during that interval.
+	IntervalEnd uint32
+
+	// Rec is reused across iterations; copy out any fields the caller
+	// needs to keep past the current step.
+	Rec *FlowRec
+}
+
+// Records returns an iterator over every record in the file. It
+// handles the interval/class/record nesting and magic-number
+// transitions internally, surfacing only real errors; a non-nil error
+// ends the iteration. The lower-level ReadIntervalHead/ReadClassHead/
+// ReadRec/ReadClassTail/ReadIntervalTail methods remain available for
+// callers that need finer control, but Records is the intended entry
+// point.
+func (ftr *FlowtupleReader) Records() iter.Seq2[RecordContext, error] {
+	return func(yield func(RecordContext, error) bool) {
+
+		var frec FlowRec
+
+		for {
+			err := ftr.ReadIntervalHead()
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				yield(RecordContext{}, err)
+				return
+			}
+
+			for {
+				err := ftr.ReadClassHead()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					yield(RecordContext{}, err)
+					return
+				}
+
+				for {
+					err := ftr.ReadRec(&frec)
+					if err == io.EOF {
+						break
+					} else if err != nil {
+						yield(RecordContext{}, err)
+						return
+					}
+
+					ctx := RecordContext{
+						Inum:          ftr.Inum(),
+						ClassId:       ftr.ClassId(),
+						IntervalStart: ftr.IntervalStart(),
+						Rec:           &frec,
+					}
+					if !yield(ctx, nil) {
+						return
+					}
+				}
+
+				if err := ftr.ReadClassTail(); err != nil {
+					yield(RecordContext{}, err)
+					return
+				}
+			}
+
+			if err := ftr.ReadIntervalTail(); err != nil {
+				yield(RecordContext{}, err)
+				return
+			}
+		}
+	}
+}